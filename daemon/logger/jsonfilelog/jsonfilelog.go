@@ -0,0 +1,207 @@
+// Package jsonfilelog provides the default Logger implementation for
+// Docker logging. This logger logs to files on the host server in the
+// JSON format.
+package jsonfilelog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/loggerutils"
+	"github.com/docker/docker/pkg/jsonlog"
+	units "github.com/docker/go-units"
+)
+
+// Name is the name of the file that the jsonlogger logs to.
+const Name = "json-file"
+
+// JSONFileLogger is Logger implementation for default Docker logging.
+type JSONFileLogger struct {
+	mu      sync.Mutex
+	closed  bool
+	writer  *loggerutils.RotateFileWriter
+	readers map[*logger.LogWatcher]struct{}
+	extra   []byte // json-encoded extra attributes
+}
+
+func init() {
+	if err := logger.RegisterLogDriver(Name, New); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := logger.RegisterLogOptValidator(Name, ValidateLogOpt); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// New creates new JSONFileLogger which writes to filename passed in
+// on instantiation
+func New(info logger.Info) (logger.Logger, error) {
+	var capval int64 = -1
+	if capacity, ok := info.Config["max-size"]; ok {
+		var err error
+		capval, err = units.FromHumanSize(capacity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxFiles := 1
+	if maxFileString, ok := info.Config["max-file"]; ok {
+		var err error
+		maxFiles, err = strconv.Atoi(maxFileString)
+		if err != nil {
+			return nil, err
+		}
+		if maxFiles < 1 {
+			return nil, fmt.Errorf("max-file cannot be less than 1")
+		}
+	}
+
+	var compress string
+	if v, ok := info.Config["compress"]; ok {
+		if !loggerutils.IsRegisteredCompression(v) {
+			return nil, fmt.Errorf("unknown compress value %q for json-file log driver", v)
+		}
+		compress = v
+	}
+
+	maxAge, err := parseLogOptDuration(info.Config, "max-age")
+	if err != nil {
+		return nil, err
+	}
+
+	rotateInterval, err := parseLogOptDuration(info.Config, "rotate-interval")
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := loggerutils.NewRotateFileWriter(info.LogPath, capval, maxFiles, compress, maxAge, rotateInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	var extra []byte
+	attrs, err := info.ExtraAttributes(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) > 0 {
+		extra, err = json.Marshal(attrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &JSONFileLogger{
+		writer:  writer,
+		readers: make(map[*logger.LogWatcher]struct{}),
+		extra:   extra,
+	}, nil
+}
+
+// parseLogOptDuration parses a log-opt value like "7d" or "1h30m" into a
+// time.Duration. "d" is accepted as a day suffix since time.ParseDuration
+// does not understand it; any other value must carry a unit that
+// time.ParseDuration accepts. A missing key returns 0.
+func parseLogOptDuration(cfg map[string]string, key string) (time.Duration, error) {
+	raw, ok := cfg[key]
+	if !ok || raw == "" {
+		return 0, nil
+	}
+
+	if hasDaySuffix(raw) {
+		days, err := strconv.Atoi(trimDaySuffix(raw))
+		if err != nil {
+			return 0, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid value for %s: must not be negative", key)
+	}
+	return d, nil
+}
+
+func hasDaySuffix(s string) bool {
+	return len(s) > 1 && s[len(s)-1] == 'd'
+}
+
+func trimDaySuffix(s string) string {
+	return s[:len(s)-1]
+}
+
+// Log converts logger.Message to jsonlog.JSONLog and serializes it to file.
+func (l *JSONFileLogger) Log(msg *logger.Message) error {
+	timestamp := msg.Timestamp
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := marshalMessage(msg, timestamp, l.extra, l.writer)
+	logger.PutMessage(msg)
+	return err
+}
+
+func marshalMessage(msg *logger.Message, timestamp time.Time, extra []byte, w *loggerutils.RotateFileWriter) error {
+	b, err := (&jsonlog.JSONLogs{
+		Log:      append(msg.Line, '\n'),
+		Stream:   msg.Source,
+		Created:  timestamp,
+		RawAttrs: extra,
+	}).MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("error writing log message to disk: %v", err)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ValidateLogOpt looks for json specific log options max-file, max-size,
+// compress, max-age and rotate-interval.
+func ValidateLogOpt(cfg map[string]string) error {
+	for key, val := range cfg {
+		switch key {
+		case "max-file":
+		case "max-size":
+		case "compress":
+			if !loggerutils.IsRegisteredCompression(val) {
+				return fmt.Errorf("unknown compress value %q for json-file log driver", val)
+			}
+		case "max-age":
+		case "rotate-interval":
+		case "labels":
+		case "env":
+		case "env-regex":
+		case "tag":
+		default:
+			return fmt.Errorf("unknown log opt %q for json-file log driver", key)
+		}
+	}
+	return nil
+}
+
+// Close closes underlying file and signals all readers to stop.
+func (l *JSONFileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	err := l.writer.Close()
+	for r := range l.readers {
+		r.Close()
+		delete(l.readers, r)
+	}
+	return err
+}
+
+// Name returns name of this logger.
+func (l *JSONFileLogger) Name() string {
+	return Name
+}
@@ -97,7 +97,7 @@ func TestJSONFileLoggerWithOpts(t *testing.T) {
 	}
 	defer os.RemoveAll(tmp)
 	filename := filepath.Join(tmp, "container.log")
-	config := map[string]string{"max-file": "3", "max-size": "1k", "compression": "gzip"}
+	config := map[string]string{"max-file": "3", "max-size": "1k", "compress": "gzip"}
 	l, err := New(logger.Info{
 		ContainerID: cid,
 		LogPath:     filename,
@@ -106,12 +106,17 @@ func TestJSONFileLoggerWithOpts(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer l.Close()
 	for i := 0; i < 36; i++ {
 		if err := l.Log(&logger.Message{Line: []byte("line" + strconv.Itoa(i)), Source: "src1"}); err != nil {
 			t.Fatal(err)
 		}
 	}
+	// Rotation folds (rename, compress, prune) run on a background worker;
+	// Close blocks until it has drained, so the segment files below are only
+	// guaranteed to exist once it returns.
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
 	res, err := ioutil.ReadFile(filename)
 	if err != nil {
 		t.Fatal(err)
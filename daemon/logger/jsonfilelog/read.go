@@ -0,0 +1,196 @@
+package jsonfilelog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/pkg/jsonlog"
+)
+
+// ReadLogs implements the logger.LogReader interface for the JSON File
+// logger. It walks the rotated segments oldest-first followed by the
+// active log file, optionally tailing new writes as they arrive.
+func (l *JSONFileLogger) ReadLogs(config logger.ReadConfig) *logger.LogWatcher {
+	watcher := logger.NewLogWatcher()
+	go l.readLogs(watcher, config)
+	return watcher
+}
+
+func (l *JSONFileLogger) readLogs(watcher *logger.LogWatcher, config logger.ReadConfig) {
+	defer close(watcher.Msg)
+
+	l.mu.Lock()
+	l.readers[watcher] = struct{}{}
+	name := l.writer.LogPath()
+	maxFiles := l.writer.MaxFiles()
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.readers, watcher)
+		l.mu.Unlock()
+	}()
+
+	for i := maxFiles - 1; i >= 1; i-- {
+		segment := name + "." + strconv.Itoa(i)
+		if err := l.readSegment(segment, config, watcher); err != nil {
+			if !os.IsNotExist(err) {
+				watcher.Err <- err
+			}
+			continue
+		}
+	}
+
+	if !config.Follow {
+		if err := l.readSegment(name, config, watcher); err != nil && !os.IsNotExist(err) {
+			watcher.Err <- err
+		}
+		return
+	}
+
+	l.followActiveFile(name, config, watcher)
+}
+
+// followPollInterval bounds how long followActiveFile can go without
+// noticing a write appended to the active file with nothing else to wake it
+// up; NotifyRotate only fires on rotation, not on every Write.
+const followPollInterval = 100 * time.Millisecond
+
+// followActiveFile tails the active log file for ReadLogs' Follow mode. It
+// keeps a single decoder positioned at the end of whatever it has already
+// delivered, so a write appended between polls is picked up instead of
+// re-reading the file from the start. On NotifyRotate it keeps decoding from
+// the same, now-renamed file until that drains (the open descriptor still
+// refers to it after the rename, so this is exactly the tail the writer
+// produced right up to the rotation) and only then reopens name, which by
+// then refers to the fresh, post-rotation file.
+func (l *JSONFileLogger) followActiveFile(name string, config logger.ReadConfig, watcher *logger.LogWatcher) {
+	notify := l.writer.NotifyRotate()
+	defer l.writer.NotifyRotateEvict(notify)
+
+	f, meta, err := l.writer.OpenSegment(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			watcher.Err <- err
+		}
+		return
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	skip := meta != nil && !config.Since.IsZero() && meta.LastTime.Before(config.Since)
+	rotated := false
+
+	for {
+		var jl jsonlog.JSONLog
+		decErr := dec.Decode(&jl)
+		if decErr == nil {
+			if !skip && (config.Since.IsZero() || !jl.Created.Before(config.Since)) {
+				msg := &logger.Message{
+					Line:      []byte(jl.Log),
+					Source:    jl.Stream,
+					Timestamp: jl.Created,
+				}
+				select {
+				case watcher.Msg <- msg:
+				case <-watcher.WatchClose():
+					f.Close()
+					return
+				}
+			}
+			continue
+		}
+
+		// io.ErrUnexpectedEOF shows up here too, not just io.EOF: a poll can
+		// land mid-write and see a torn trailing record. Treat it the same
+		// as a clean EOF and let the next poll pick up the rest once the
+		// write completes, rather than tearing down the follower.
+		if decErr != io.EOF && decErr != io.ErrUnexpectedEOF {
+			watcher.Err <- fmt.Errorf("error decoding log entry in %s: %v", name, decErr)
+			f.Close()
+			return
+		}
+
+		if rotated {
+			f.Close()
+			nf, nmeta, nerr := l.writer.OpenSegment(name)
+			if nerr != nil {
+				if !os.IsNotExist(nerr) {
+					watcher.Err <- nerr
+				}
+				return
+			}
+			f = nf
+			dec = json.NewDecoder(bufio.NewReader(f))
+			skip = nmeta != nil && !config.Since.IsZero() && nmeta.LastTime.Before(config.Since)
+			rotated = false
+			continue
+		}
+
+		// json.Decoder's EOF is sticky: carry whatever it has buffered (a
+		// torn trailing record, if any) into a fresh decoder on f so the
+		// next pass resumes where this one stopped.
+		dec = json.NewDecoder(io.MultiReader(dec.Buffered(), f))
+
+		select {
+		case <-notify:
+			// Don't switch files yet: f still refers to the just-rotated
+			// file under its rotated name (".1.tmp.N", later ".1"), and may
+			// hold a final write made just before rotation that hasn't been
+			// decoded yet.
+			rotated = true
+		case <-time.After(followPollInterval):
+		case <-watcher.WatchClose():
+			f.Close()
+			return
+		}
+	}
+}
+
+// readSegment streams the JSON-encoded messages in a single rotated or
+// active log segment (".N" or its compressed ".N.gz" form) to watcher,
+// skipping the whole segment without decompressing it if its recorded
+// lastTime predates config.Since.
+func (l *JSONFileLogger) readSegment(name string, config logger.ReadConfig, watcher *logger.LogWatcher) error {
+	f, meta, err := l.writer.OpenSegment(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if meta != nil && !config.Since.IsZero() && meta.LastTime.Before(config.Since) {
+		return nil
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var jl jsonlog.JSONLog
+		if err := dec.Decode(&jl); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("error decoding log entry in %s: %v", name, err)
+		}
+
+		if !config.Since.IsZero() && jl.Created.Before(config.Since) {
+			continue
+		}
+
+		msg := &logger.Message{
+			Line:      []byte(jl.Log),
+			Source:    jl.Stream,
+			Timestamp: jl.Created,
+		}
+
+		select {
+		case watcher.Msg <- msg:
+		case <-watcher.WatchClose():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package loggerutils
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// CompressionCodec lets a rotated log segment be written and later read back
+// in a given compressed format. Built-in gzip, bzip2 and xz codecs are
+// registered by name below; third parties can add their own with Register.
+type CompressionCodec interface {
+	// Extension returns the filename suffix this codec appends to rotated
+	// segments it compresses, e.g. ".gz".
+	Extension() string
+	// NewWriter wraps w so that writes to it are compressed.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader wraps r so that reads from it are decompressed.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMu sync.Mutex
+	codecs   = map[string]CompressionCodec{}
+)
+
+// Register adds a CompressionCodec under name, e.g. "gzip", overwriting any
+// codec previously registered under the same name. jsonfilelog's "compress"
+// log-opt and the rotation/read paths in this package both resolve against
+// this registry rather than a hardcoded list.
+func Register(name string, c CompressionCodec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[name] = c
+}
+
+// LookupCodec returns the codec registered under name, if any.
+func LookupCodec(name string) (CompressionCodec, bool) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// lookupByExtension returns the codec whose Extension() matches ext (e.g.
+// ".gz"), if any is registered.
+func lookupByExtension(ext string) (CompressionCodec, bool) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	for _, c := range codecs {
+		if c.Extension() == ext {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// registeredExtensions lists the Extension() of every registered codec, used
+// to probe for a rotated segment's compressed form when reading.
+func registeredExtensions() []string {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	exts := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		exts = append(exts, c.Extension())
+	}
+	return exts
+}
+
+// existingSegmentExtension reports which form of base is actually present on
+// disk: "" if the plain, uncompressed file exists, or the Extension() of
+// whichever registered codec compressed it otherwise. This lets rotation
+// shift a segment into its new slot under its own extension rather than the
+// extension the compress option currently asks for, so a segment compressed
+// (or left plain) under a since-changed compress setting is never mistaken
+// for missing and orphaned.
+func existingSegmentExtension(base string) (ext string, ok bool) {
+	if _, err := os.Stat(base); err == nil {
+		return "", true
+	}
+	for _, ext := range registeredExtensions() {
+		if _, err := os.Stat(base + ext); err == nil {
+			return ext, true
+		}
+	}
+	return "", false
+}
+
+// IsRegisteredCompression reports whether name is a known codec, or the
+// empty string (meaning "no compression").
+func IsRegisteredCompression(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := LookupCodec(name)
+	return ok
+}
+
+func init() {
+	Register("gzip", gzipCodec{})
+	Register("bzip2", streamCodec{ext: ".bz", alg: archive.Bzip2})
+	Register("xz", streamCodec{ext: ".xz", alg: archive.Xz})
+}
+
+// gzipCodec uses the standard library directly, rather than going through
+// pkg/archive, so that compressFile can stamp a SegmentMeta into the gzip
+// header's Comment field at write time.
+type gzipCodec struct{}
+
+func (gzipCodec) Extension() string { return ".gz" }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return gr, nil
+}
+
+// streamCodec covers compression formats the standard library can only
+// decode (bzip2) or not handle at all (xz), delegating to pkg/archive,
+// which shells out to the matching command-line tool for compression.
+type streamCodec struct {
+	ext string
+	alg archive.Compression
+}
+
+func (c streamCodec) Extension() string { return c.ext }
+
+func (c streamCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return archive.CompressStream(w, c.alg)
+}
+
+func (c streamCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c.alg {
+	case archive.Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	default:
+		return archive.DecompressStream(r)
+	}
+}
+
+// peekGzipComment reads just enough of a gzip file to recover the
+// SegmentMeta JSON blob compressFile stamped into the header's Comment
+// field, without decompressing the payload.
+func peekGzipComment(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gr.Close()
+	return gr.Comment, nil
+}
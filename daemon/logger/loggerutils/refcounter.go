@@ -0,0 +1,48 @@
+package loggerutils
+
+import "sync"
+
+// RefCounter tracks how many readers currently have a rotated log segment
+// open by path. compressFile consults it and leaves a referenced segment's
+// uncompressed file in place; shifting segments between slots, overwriting
+// the oldest slot and max-age pruning do not consult it.
+type RefCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewRefCounter creates a new, empty RefCounter.
+func NewRefCounter() *RefCounter {
+	return &RefCounter{counts: make(map[string]int)}
+}
+
+// GetReference increments the reference count for name and returns the
+// count after the increment.
+func (r *RefCounter) GetReference(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[name]++
+	return r.counts[name]
+}
+
+// Dereference decrements the reference count for name and reports whether
+// the file is now unreferenced (count dropped to zero or was already
+// zero/unknown).
+func (r *RefCounter) Dereference(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count, ok := r.counts[name]
+	if !ok || count <= 1 {
+		delete(r.counts, name)
+		return true
+	}
+	r.counts[name] = count - 1
+	return false
+}
+
+// Referenced reports whether name currently has any outstanding references.
+func (r *RefCounter) Referenced(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[name] > 0
+}
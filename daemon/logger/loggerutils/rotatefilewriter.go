@@ -1,29 +1,57 @@
 package loggerutils
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
-	"github.com/docker/docker/pkg/archive"
+	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/pubsub"
 )
 
 // RotateFileWriter is Logger implementation for default Docker logging.
 type RotateFileWriter struct {
-	f            *os.File // store for closing
-	mu           sync.Mutex
-	capacity     int64  //maximum size of each file
-	currentSize  int64  // current size of the latest file
-	maxFiles     int    //maximum number of files
-	compress     string // whether old versions of log files are compressed
-	notifyRotate *pubsub.Publisher
+	f              *os.File // store for closing
+	mu             sync.Mutex
+	capacity       int64         //maximum size of each file
+	currentSize    int64         // current size of the latest file
+	maxFiles       int           //maximum number of files
+	compress       string        // whether old versions of log files are compressed
+	maxAge         time.Duration // rotated files older than this are pruned, 0 disables
+	rotateInterval time.Duration // force a rotation on this cadence regardless of size, 0 disables
+	lastRotate     time.Time     // time of the last rotation, used to drive rotateInterval
+	notifyRotate   *pubsub.Publisher
+	closed         chan struct{}
+	refs           *RefCounter // tracks rotated segments currently open for reading
+
+	rotateMu     sync.Mutex     // serializes the background worker's rotation bookkeeping
+	fsopMu       sync.RWMutex   // readers RLock while opening a segment; the worker Locks while shuffling/compressing segments on disk
+	rotateSeq    uint64         // source of unique ".1.tmp" names so back-to-back rotations never collide
+	rotateJobs   chan rotateJob // fast path hands off the slow shuffle/compress work here
+	rotateDone   chan struct{}  // closed once the worker has drained rotateJobs, for Close to wait on
+	periodicDone chan struct{}  // closed once runPeriodicRotation has exited (or immediately, if never started), for Close to wait on before it closes rotateJobs
+}
+
+// rotateJob is the work handed from the fast, mutex-held rename sequence in
+// doRotate to the background worker: fold tmpPath (the just-closed active
+// file) into the numbered segment history for name.
+type rotateJob struct {
+	name     string
+	tmpPath  string
+	maxFiles int
+	compress string
+	maxAge   time.Duration
+	refs     *RefCounter
 }
 
-//NewRotateFileWriter creates new RotateFileWriter
-func NewRotateFileWriter(logPath string, capacity int64, maxFiles int, compress string) (*RotateFileWriter, error) {
+// NewRotateFileWriter creates new RotateFileWriter
+func NewRotateFileWriter(logPath string, capacity int64, maxFiles int, compress string, maxAge, rotateInterval time.Duration) (*RotateFileWriter, error) {
 	log, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
 	if err != nil {
 		return nil, err
@@ -34,17 +62,118 @@ func NewRotateFileWriter(logPath string, capacity int64, maxFiles int, compress
 		return nil, err
 	}
 
-	return &RotateFileWriter{
-		f:            log,
-		capacity:     capacity,
-		currentSize:  size,
-		maxFiles:     maxFiles,
-		compress:     compress,
-		notifyRotate: pubsub.NewPublisher(0, 1),
-	}, nil
+	w := &RotateFileWriter{
+		f:              log,
+		capacity:       capacity,
+		currentSize:    size,
+		maxFiles:       maxFiles,
+		compress:       compress,
+		maxAge:         maxAge,
+		rotateInterval: rotateInterval,
+		lastRotate:     time.Now(),
+		notifyRotate:   pubsub.NewPublisher(0, 1),
+		closed:         make(chan struct{}),
+		refs:           NewRefCounter(),
+		rotateJobs:     make(chan rotateJob, rotateJobQueueSize),
+		rotateDone:     make(chan struct{}),
+		periodicDone:   make(chan struct{}),
+	}
+
+	go w.rotateWorker()
+
+	if maxAge > 0 || rotateInterval > 0 {
+		go w.runPeriodicRotation()
+	} else {
+		close(w.periodicDone)
+	}
+
+	return w, nil
+}
+
+// rotateJobQueueSize is generous relative to any reasonable maxFiles: it
+// only needs to absorb rotations dispatched faster than the single worker
+// can fold them into the numbered segment history, which in practice means
+// "more than one rotation's worth of compression behind".
+const rotateJobQueueSize = 8
+
+// rotateWorker is the single goroutine that performs the slow part of
+// rotation (shuffling and compressing older segments) so that doRotate never
+// blocks a writer on it. Jobs are processed strictly in the order they were
+// dispatched, which keeps segment numbering chronological even when several
+// rotations are triggered back-to-back.
+func (w *RotateFileWriter) rotateWorker() {
+	defer close(w.rotateDone)
+	for job := range w.rotateJobs {
+		w.rotateMu.Lock()
+		if err := w.foldRotatedSegment(job); err != nil {
+			logrus.Errorf("error rotating log %q: %v", job.name, err)
+		}
+		w.rotateMu.Unlock()
+	}
+}
+
+// runPeriodicRotation drives rotation that isn't triggered by Write, i.e.
+// pruning of aged-out segments and the fixed rotate-interval cadence. It
+// wakes up at the finest granularity the two settings require and grabs the
+// same mutex Write uses so rotation is never interleaved with a write.
+func (w *RotateFileWriter) runPeriodicRotation() {
+	defer close(w.periodicDone)
+
+	tick := w.maxAge
+	if w.rotateInterval > 0 && (tick == 0 || w.rotateInterval < tick) {
+		tick = w.rotateInterval
+	}
+	if tick <= 0 {
+		return
+	}
+	// Never poll less often than once a minute. There is no lower bound: a
+	// tiny interval is polled at that interval.
+	if tick > time.Minute {
+		tick = time.Minute
+	}
+
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.mu.Lock()
+			if err := w.rotateIfDue(); err != nil {
+				w.mu.Unlock()
+				continue
+			}
+			w.mu.Unlock()
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// rotateIfDue rotates the current file if rotateInterval has elapsed since
+// the last rotation, or if maxAge alone has — otherwise an active file aged
+// past maxAge with no size- or interval-based trigger would sit there
+// growing forever, since there would be nothing else left to rotate it into
+// a segment maxAge pruning could ever reach. It then always prunes segments
+// older than maxAge. w.mu must be held.
+func (w *RotateFileWriter) rotateIfDue() error {
+	age := time.Since(w.lastRotate)
+	if (w.rotateInterval > 0 && age >= w.rotateInterval) || (w.maxAge > 0 && age >= w.maxAge) {
+		if err := w.doRotate(); err != nil {
+			return err
+		}
+	}
+	if w.maxAge > 0 {
+		w.fsopMu.Lock()
+		err := pruneAged(w.f.Name(), w.maxFiles, w.compress, w.maxAge)
+		w.fsopMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-//WriteLog write log message to File
+// WriteLog write log message to File
 func (w *RotateFileWriter) Write(message []byte) (int, error) {
 	w.mu.Lock()
 	if err := w.checkCapacityAndRotate(); err != nil {
@@ -61,131 +190,359 @@ func (w *RotateFileWriter) Write(message []byte) (int, error) {
 }
 
 func (w *RotateFileWriter) checkCapacityAndRotate() error {
-	if w.capacity == -1 {
+	due := w.capacity != -1 && w.currentSize >= w.capacity
+	if !due && w.rotateInterval > 0 && time.Since(w.lastRotate) >= w.rotateInterval {
+		due = true
+	}
+	if !due {
 		return nil
 	}
 
-	if w.currentSize >= w.capacity {
-		name := w.f.Name()
-		if err := w.f.Close(); err != nil {
-			return err
-		}
-		if err := rotate(name, w.maxFiles, w.compress); err != nil {
-			return err
-		}
-		file, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 06400)
-		if err != nil {
-			return err
-		}
-		w.f = file
-		w.currentSize = 0
-		w.notifyRotate.Publish(struct{}{})
+	return w.doRotate()
+}
+
+// doRotate performs only the fast filesystem sequence needed to get the
+// writer back to accepting writes: close the current file, rename it out of
+// the way, and open a fresh one in its place. w.mu must be held, and stays
+// held only for this sequence — folding the just-closed file into the
+// numbered segment history (shuffling older segments, compressing) is
+// handed off to the background worker so it never stalls a writer.
+func (w *RotateFileWriter) doRotate() error {
+	name := w.f.Name()
+	if err := w.f.Close(); err != nil {
+		return err
 	}
 
+	w.rotateSeq++
+	tmpPath := name + ".1.tmp." + strconv.FormatUint(w.rotateSeq, 10)
+	if err := os.Rename(name, tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 06400)
+	if err != nil {
+		return err
+	}
+	w.f = file
+	w.currentSize = 0
+	w.lastRotate = time.Now()
+	w.notifyRotate.Publish(struct{}{})
+
+	if w.maxFiles < 2 {
+		os.Remove(tmpPath)
+		return nil
+	}
+
+	// Always go through the channel, even if it's full: folding the job in
+	// right here instead would let it jump ahead of whatever's still queued,
+	// scrambling segment numbering relative to dispatch order. Blocking until
+	// the worker frees a slot is the only way to hand off work without
+	// breaking that ordering; it's also the only case where rotation can
+	// block a writer.
+	job := rotateJob{name: name, tmpPath: tmpPath, maxFiles: w.maxFiles, compress: w.compress, maxAge: w.maxAge, refs: w.refs}
+	w.rotateJobs <- job
 	return nil
 }
 
-func rotate(name string, maxFiles int, compress string) error {
-	if maxFiles < 2 {
-		return nil
+// foldRotatedSegment shifts the existing numbered segments for name down by
+// one slot and claims job.tmpPath as the new, uncompressed "name.1",
+// compressing what had been "name.1" into "name.2". It takes fsopMu for its
+// duration so a reader opening a segment never observes a half-renamed
+// file.
+func (w *RotateFileWriter) foldRotatedSegment(job rotateJob) error {
+	w.fsopMu.Lock()
+	defer w.fsopMu.Unlock()
+
+	var codec CompressionCodec
+	newExt := ""
+	if job.compress != "" {
+		var ok bool
+		codec, ok = LookupCodec(job.compress)
+		if !ok {
+			return fmt.Errorf("unknown compression algorithm %q for json-file", job.compress)
+		}
+		newExt = codec.Extension()
 	}
 
-	extension := ""
-	var compressionAlg archive.Compression
-	if compress != "" {
-		switch compress {
-		case "gzip":
-			compressionAlg = archive.Gzip
-			extension = ".gz"
-		case "bzip2":
-			compressionAlg = archive.Bzip2
-			extension = ".bz"
-		case "xz":
-			compressionAlg = archive.Xz
-			extension = ".xz"
-		default:
-			return fmt.Errorf("unknown compression algorithm %q for json-file", compress)
-		}
-	}
-
-	for i := maxFiles - 1; i > 2; i-- {
-		toPath := name + "." + strconv.Itoa(i) + extension
-		fromPath := name + "." + strconv.Itoa(i-1) + extension
-		if err := os.Rename(fromPath, toPath); err != nil && !os.IsNotExist(err) {
+	// Each slot is shifted down under whichever extension it actually has on
+	// disk, not the extension the current compress setting would produce: a
+	// segment compressed (or left plain) before a mid-life change to
+	// compress must still be found and moved. Any stale file already sitting
+	// in the destination slot under a different extension is cleared first,
+	// or it would survive alongside the freshly-shifted file as an orphan.
+	name := job.name
+	for i := job.maxFiles - 1; i > 2; i-- {
+		fromBase := name + "." + strconv.Itoa(i-1)
+		ext, ok := existingSegmentExtension(fromBase)
+		if !ok {
+			continue
+		}
+		toBase := name + "." + strconv.Itoa(i)
+		if err := clearStaleSegment(toBase, ext); err != nil {
+			return err
+		}
+		if err := os.Rename(fromBase+ext, toBase+ext); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
 
-	if _, err := os.Stat(name + ".1"); err == nil && maxFiles > 2 {
+	if _, err := os.Stat(name + ".1"); err == nil && job.maxFiles > 2 {
+		if err := clearStaleSegment(name+".2", newExt); err != nil {
+			return err
+		}
 		if err := os.Rename(name+".1", name+".2"); err != nil {
 			return err
 		}
-
-		if err := compressFile(name+".2", compressionAlg, extension); err != nil {
+		if err := compressFile(name+".2", codec, job.refs); err != nil {
 			return err
 		}
 	}
 
-	// The "[name].1" that jast renamed from "[name]" is not compressed
-	// in order to prevent the log tracking tool from losing some historical
-	// log data when a new log file is created.
-	if err := os.Rename(name, name+".1"); err != nil && !os.IsNotExist(err) {
+	// "name.1" is always left uncompressed, freshly claimed from tmpPath, so
+	// a log tracking tool following "name.1" never loses data to a
+	// compression race.
+	if err := os.Rename(job.tmpPath, name+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if job.maxAge > 0 {
+		return pruneAged(name, job.maxFiles, job.compress, job.maxAge)
+	}
+	return nil
+}
+
+// clearStaleSegment removes the file at base, if one exists under an
+// extension other than keepExt, so a rename or compress about to claim
+// base+keepExt doesn't leave that slot's previous file behind as an orphan.
+func clearStaleSegment(base, keepExt string) error {
+	ext, ok := existingSegmentExtension(base)
+	if !ok || ext == keepExt {
+		return nil
+	}
+	if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
 }
 
-func compressFile(fileName string, compression archive.Compression, extension string) (err error) {
-	outFile, err := os.OpenFile(fileName+extension, os.O_CREATE|os.O_RDWR, 0640)
+// compressFile compresses fileName with codec, writing fileName+codec.Extension().
+// A nil codec means "no compression configured" and is a no-op.
+func compressFile(fileName string, codec CompressionCodec, refs *RefCounter) (err error) {
+	if codec == nil {
+		return nil
+	}
+
+	outFile, err := os.OpenFile(fileName+codec.Extension(), os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		outFile.Close()
 		if err != nil {
-			os.Remove(fileName + extension)
+			os.Remove(fileName + codec.Extension())
 		}
 	}()
 
+	fileData, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		return err
 	}
 
-	compressWriter, err := archive.CompressStream(outFile, compression)
-	defer compressWriter.Close()
-
-	fileData, err := ioutil.ReadFile(fileName)
+	compressWriter, err := codec.NewWriter(outFile)
 	if err != nil {
 		return err
 	}
-	_, err = compressWriter.Write(fileData)
-	if err != nil {
+	if gw, ok := compressWriter.(*gzip.Writer); ok {
+		// Stamp the last-modified time of the segment being compressed into
+		// the gzip header so a reader can decide whether to skip the whole
+		// file (e.g. because it predates ReadConfig.Since) without having
+		// to decompress it first.
+		info, statErr := os.Stat(fileName)
+		if statErr != nil {
+			compressWriter.Close()
+			return statErr
+		}
+		meta, jsonErr := json.Marshal(SegmentMeta{LastTime: info.ModTime()})
+		if jsonErr != nil {
+			compressWriter.Close()
+			return jsonErr
+		}
+		gw.Comment = string(meta)
+	}
+
+	if _, err = compressWriter.Write(fileData); err != nil {
+		compressWriter.Close()
+		return err
+	}
+	if err = compressWriter.Close(); err != nil {
 		return err
 	}
 
+	if refs != nil && refs.Referenced(fileName) {
+		// A reader still has this segment open under its pre-compression
+		// name; leave it in place beside the compressed copy. Later
+		// rotations shift it along uncompressed; it is not compressed again.
+		return nil
+	}
 	os.Remove(fileName)
 
 	return nil
 }
 
+// pruneAged removes rotated segments of name (".1".."maxFiles-1", with the
+// compress extension where applicable) whose modtime is older than maxAge.
+// ".1" is eligible like any other segment: with max-age configured alone
+// (no max-size or rotate-interval), it's the only thing rotateIfDue's
+// age-triggered rotation ever produces, so age pruning must be able to
+// reach it too, or the oldest rotation a max-age-only config makes would
+// never get cleaned up. Only the still-open active file is exempt.
+func pruneAged(name string, maxFiles int, compress string, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		return nil
+	}
+
+	extension := extensionForCompression(compress)
+	cutoff := time.Now().Add(-maxAge)
+
+	for i := 1; i < maxFiles; i++ {
+		for _, candidate := range []string{
+			name + "." + strconv.Itoa(i) + extension,
+			name + "." + strconv.Itoa(i),
+		} {
+			info, err := os.Stat(candidate)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().Before(cutoff) {
+				if err := os.Remove(candidate); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func extensionForCompression(compress string) string {
+	codec, ok := LookupCodec(compress)
+	if !ok {
+		return ""
+	}
+	return codec.Extension()
+}
+
 // LogPath returns the location the given writer logs to.
 func (w *RotateFileWriter) LogPath() string {
 	return w.f.Name()
 }
 
+// SegmentMeta is the metadata stamped into a compressed rotated segment's
+// gzip header at compress time, so a reader can decide whether the whole
+// segment is worth decompressing.
+type SegmentMeta struct {
+	LastTime time.Time `json:"lastTime"`
+}
+
+// OpenSegment opens a rotated log segment for reading, trying name itself
+// and then name plus the extension of every registered CompressionCodec, so
+// third-party codecs registered via Register are picked up automatically. It
+// takes w.fsopMu for the duration of the open so a concurrent rotation can't
+// rename or remove the segment out from under it mid-open, and additionally
+// holds a RefCounter reference on name for the lifetime of the returned
+// ReadCloser. Only compressFile checks that reference (it then keeps the
+// uncompressed file); shifting segments between slots, overwriting the
+// oldest slot and max-age pruning do not check it.
+// meta is nil unless the segment was compressed with gzip and carries a
+// recorded lastTime.
+func (w *RotateFileWriter) OpenSegment(name string) (rc io.ReadCloser, meta *SegmentMeta, err error) {
+	w.fsopMu.RLock()
+	defer w.fsopMu.RUnlock()
+
+	w.refs.GetReference(name)
+	release := func() {
+		w.refs.Dereference(name)
+	}
+
+	if f, ferr := os.Open(name); ferr == nil {
+		return &segmentReader{ReadCloser: ioutil.NopCloser(f), f: f, release: release}, nil, nil
+	} else if !os.IsNotExist(ferr) {
+		release()
+		return nil, nil, ferr
+	}
+
+	for _, ext := range registeredExtensions() {
+		path := name + ext
+		f, ferr := os.Open(path)
+		if ferr != nil {
+			continue
+		}
+
+		codec, _ := lookupByExtension(ext)
+		if ext == ".gz" {
+			if comment, cerr := peekGzipComment(path); cerr == nil && comment != "" {
+				var m SegmentMeta
+				if jerr := json.Unmarshal([]byte(comment), &m); jerr == nil {
+					meta = &m
+				}
+			}
+		}
+
+		decoded, derr := codec.NewReader(f)
+		if derr != nil {
+			f.Close()
+			release()
+			return nil, nil, derr
+		}
+		return &segmentReader{ReadCloser: decoded, f: f, release: release}, meta, nil
+	}
+
+	release()
+	return nil, nil, os.ErrNotExist
+}
+
+// segmentReader closes both the decompressor (if any) and the underlying
+// file, and releases the segment's RefCounter reference, exactly once.
+type segmentReader struct {
+	io.ReadCloser
+	f       *os.File
+	release func()
+}
+
+func (s *segmentReader) Close() error {
+	err := s.ReadCloser.Close()
+	if ferr := s.f.Close(); err == nil {
+		err = ferr
+	}
+	s.release()
+	return err
+}
+
 // MaxFiles return maximum number of files
 func (w *RotateFileWriter) MaxFiles() int {
 	return w.maxFiles
 }
 
-//NotifyRotate returns the new subscriber
+// NotifyRotate returns the new subscriber
 func (w *RotateFileWriter) NotifyRotate() chan interface{} {
 	return w.notifyRotate.Subscribe()
 }
 
-//NotifyRotateEvict removes the specified subscriber from receiving any more messages.
+// NotifyRotateEvict removes the specified subscriber from receiving any more messages.
 func (w *RotateFileWriter) NotifyRotateEvict(sub chan interface{}) {
 	w.notifyRotate.Evict(sub)
 }
 
 // Close closes underlying file and signals all readers to stop.
 func (w *RotateFileWriter) Close() error {
+	if w.maxAge > 0 || w.rotateInterval > 0 {
+		close(w.closed)
+	}
+	// Wait for runPeriodicRotation to actually exit before closing
+	// rotateJobs: otherwise a doRotate it triggered concurrently with this
+	// Close could still be sending into rotateJobs after we close it, which
+	// panics.
+	<-w.periodicDone
+	close(w.rotateJobs)
+	<-w.rotateDone
 	return w.f.Close()
 }